@@ -0,0 +1,45 @@
+package tprstorage
+
+import (
+	"github.com/giantswarm/microerror"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Backend selects which Kubernetes API Storage talks to in order to
+// persist its data object.
+type Backend string
+
+const (
+	// BackendTPR stores data in a ThirdPartyResource object. TPRs were
+	// removed in Kubernetes 1.8, so this backend only works against
+	// older clusters.
+	BackendTPR Backend = "tpr"
+	// BackendCRD stores data in a CustomResourceDefinition object. This
+	// is the backend to use against Kubernetes 1.7+ clusters.
+	BackendCRD Backend = "crd"
+	// BackendAuto probes the API server's discovery endpoint for
+	// apiextensions.k8s.io support and resolves to BackendCRD when it is
+	// found, falling back to BackendTPR on older clusters.
+	BackendAuto Backend = "auto"
+)
+
+// apiExtensionsGroup is the discovery API group name that indicates a
+// cluster understands CustomResourceDefinitions.
+const apiExtensionsGroup = "apiextensions.k8s.io"
+
+// detectBackend probes the API server's discovery endpoint to find out
+// whether it understands CustomResourceDefinitions.
+func detectBackend(k8sClient kubernetes.Interface) (Backend, error) {
+	groups, err := k8sClient.Discovery().ServerGroups()
+	if err != nil {
+		return "", microerror.Maskf(err, "listing server groups")
+	}
+
+	for _, g := range groups.Groups {
+		if g.Name == apiExtensionsGroup {
+			return BackendCRD, nil
+		}
+	}
+
+	return BackendTPR, nil
+}
@@ -0,0 +1,139 @@
+package tprstorage
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// CASConfig configures the compare-and-swap retry loop PutIf runs.
+type CASConfig struct {
+	// MaxRetries is the number of times PutIf re-reads the shard and
+	// retries tryUpdate after a resourceVersion conflict before giving
+	// up. Zero falls back to DefaultConfig's value.
+	MaxRetries int
+}
+
+// TryUpdateFunc computes the next state of a shard's data map given its
+// current contents. The returned map becomes the new data map. Returning
+// an error aborts the compare-and-swap loop without retrying.
+type TryUpdateFunc func(data map[string]string) (map[string]string, error)
+
+const (
+	casBackoffBase = 10 * time.Millisecond
+	casBackoffMax  = 1 * time.Second
+)
+
+// PutIf atomically updates the data stored under the shard key hashes to,
+// using a compare-and-swap loop. tryUpdate is called with the shard's
+// current data map and must return the desired next state. If the update
+// conflicts with a write made by another writer in the meantime, the
+// shard is re-read and tryUpdate is invoked again against the fresh data,
+// up to the configured retry budget.
+func (s *Storage) PutIf(ctx context.Context, key string, tryUpdate TryUpdateFunc) error {
+	err := s.casUpdateNamed(ctx, s.shardName(key), tryUpdate, nil)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// casUpdateNamed runs the compare-and-swap loop against the TPO/CR called
+// name, creating it (empty) first if it does not exist yet. annotations,
+// if non-nil, is merged into the object's annotations as part of the same
+// compare-and-swap PUT as the data update, so a caller that needs to
+// record metadata alongside a shard's data (e.g. Rebalance's shard-count
+// annotation) doesn't have to follow up with a second, unprotected write.
+func (s *Storage) casUpdateNamed(ctx context.Context, name string, tryUpdate TryUpdateFunc, annotations map[string]string) error {
+	obj, err := s.getOrCreateNamedCustomObject(ctx, name, nil)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	// origStateIsCurrent tracks whether obj.Data is known to be the
+	// latest state on the server, so that a no-op tryUpdate does not
+	// need to round-trip an update that would just come back as
+	// "already up to date".
+	origStateIsCurrent := true
+
+	for attempt := 0; ; attempt++ {
+		// tryUpdate is allowed to mutate the map it is handed in place
+		// (Put/Delete/Apply all do), so snapshot it first: comparing
+		// against obj.Data after the call would compare the map to
+		// itself and always report "unchanged".
+		before := copyData(obj.Data)
+
+		newData, err := tryUpdate(obj.Data)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+
+		annotationsChanged := false
+		for k, v := range annotations {
+			if obj.Annotations[k] != v {
+				annotationsChanged = true
+				break
+			}
+		}
+
+		if origStateIsCurrent && !annotationsChanged && reflect.DeepEqual(newData, before) {
+			return nil
+		}
+
+		obj.Data = newData
+		if len(annotations) > 0 {
+			if obj.Annotations == nil {
+				obj.Annotations = map[string]string{}
+			}
+			for k, v := range annotations {
+				obj.Annotations[k] = v
+			}
+		}
+
+		body, err := json.Marshal(obj)
+		if err != nil {
+			return microerror.Maskf(err, "marshaling %#v", obj)
+		}
+
+		_, err = s.k8sClient.Core().RESTClient().
+			Put().
+			Context(ctx).
+			AbsPath(s.namedEndpoint(name)).
+			Body(body).
+			DoRaw()
+		if err == nil {
+			return nil
+		}
+		if !errors.IsConflict(err) {
+			return microerror.Maskf(err, "updating %s", name)
+		}
+		if attempt >= s.casMaxRetries {
+			return microerror.Maskf(casRetriesExceededError, "giving up on %s after %d attempts", name, attempt+1)
+		}
+
+		obj, err = s.getOrCreateNamedCustomObject(ctx, name, nil)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		origStateIsCurrent = true
+
+		time.Sleep(casJitteredBackoff(attempt))
+	}
+}
+
+// casJitteredBackoff returns a random duration in [0, base*2^attempt),
+// capped at casBackoffMax.
+func casJitteredBackoff(attempt int) time.Duration {
+	d := casBackoffBase << uint(attempt)
+	if d <= 0 || d > casBackoffMax {
+		d = casBackoffMax
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
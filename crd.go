@@ -0,0 +1,114 @@
+package tprstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apismeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// CRDConfig describes the CustomResourceDefinition used to store data when
+// Config.Backend resolves to BackendCRD.
+type CRDConfig struct {
+	Group, Version, Description string
+}
+
+const (
+	crdKind   = "Storage"
+	crdPlural = "storages"
+
+	crdEstablishedPollInterval = 100 * time.Millisecond
+	crdEstablishedTimeout      = 30 * time.Second
+)
+
+// ensureCRD creates the CustomResourceDefinition this package stores its
+// data in. It is safe to call multiple times.
+func ensureCRD(ctx context.Context, client apiextensionsclientset.Interface, config CRDConfig) error {
+	crd := &apiextensionsv1beta1.CustomResourceDefinition{
+		ObjectMeta: apismeta.ObjectMeta{
+			Name: crdPlural + "." + config.Group,
+			Annotations: map[string]string{
+				"description": config.Description,
+			},
+		},
+		Spec: apiextensionsv1beta1.CustomResourceDefinitionSpec{
+			Group:   config.Group,
+			Version: config.Version,
+			Scope:   apiextensionsv1beta1.NamespaceScoped,
+			Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
+				Plural: crdPlural,
+				Kind:   crdKind,
+			},
+		},
+	}
+
+	_, err := client.ApiextensionsV1beta1().CustomResourceDefinitions().Create(crd)
+	if errors.IsAlreadyExists(err) {
+		return waitCRDEstablished(client, crd.Name)
+	}
+	if err != nil {
+		return microerror.Maskf(err, "creating CRD %#v", crd)
+	}
+
+	return waitCRDEstablished(client, crd.Name)
+}
+
+// waitCRDEstablished polls until the CRD's Established condition is true,
+// mirroring tpr.TPR.CreateAndWait: a CRD's REST endpoint is not guaranteed
+// to be available the instant Create returns, and the very next call
+// against it (creating shard 0) would otherwise race the API server.
+func waitCRDEstablished(client apiextensionsclientset.Interface, name string) error {
+	err := wait.Poll(crdEstablishedPollInterval, crdEstablishedTimeout, func() (bool, error) {
+		crd, err := client.ApiextensionsV1beta1().CustomResourceDefinitions().Get(name, apismeta.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		for _, cond := range crd.Status.Conditions {
+			if cond.Type == apiextensionsv1beta1.Established && cond.Status == apiextensionsv1beta1.ConditionTrue {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+	if err != nil {
+		return microerror.Maskf(err, "waiting for CRD %s to be established", name)
+	}
+
+	return nil
+}
+
+// crdEndpoint builds the REST path of the CR collection this package
+// stores its data object under.
+func crdEndpoint(namespace string, config CRDConfig) string {
+	return "/apis/" + config.Group + "/" + config.Version + "/namespaces/" + namespace + "/" + crdPlural
+}
+
+// Migrate reads all data out of a TPR-backed Storage and writes it into a
+// CRD-backed Storage, so operators can cut over from BackendTPR to
+// BackendCRD without losing data.
+func Migrate(ctx context.Context, from, to *Storage) error {
+	for i := 0; i < from.shardCount; i++ {
+		name := shardName(from.tpoName, from.shardCount, i)
+
+		data, err := from.readShardData(ctx, name)
+		if err != nil {
+			return microerror.Maskf(err, "reading %s", name)
+		}
+
+		for k, v := range data {
+			err := to.Put(ctx, k, v)
+			if err != nil {
+				return microerror.Maskf(err, "writing key=%s", k)
+			}
+		}
+	}
+
+	return nil
+}
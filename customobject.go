@@ -0,0 +1,22 @@
+package tprstorage
+
+import (
+	apismeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// customObject is the wire representation of the TPO/CR this package uses
+// to persist its key/value data, regardless of which Backend is in use.
+type customObject struct {
+	apismeta.TypeMeta   `json:",inline"`
+	apismeta.ObjectMeta `json:"metadata"`
+
+	// Data must be not empty so patches do not fail.
+	Data map[string]string `json:"data"`
+}
+
+type customObjectList struct {
+	apismeta.TypeMeta `json:",inline"`
+	apismeta.ListMeta `json:"metadata"`
+
+	Items []customObject `json:"items"`
+}
@@ -0,0 +1,26 @@
+package tprstorage
+
+import "github.com/giantswarm/microerror"
+
+var invalidConfigError = microerror.New("invalid config")
+
+// IsInvalidConfig asserts invalidConfigError.
+func IsInvalidConfig(err error) bool {
+	return microerror.Cause(err) == invalidConfigError
+}
+
+var notFoundError = microerror.New("not found")
+
+// IsNotFound asserts notFoundError.
+func IsNotFound(err error) bool {
+	return microerror.Cause(err) == notFoundError
+}
+
+var casRetriesExceededError = microerror.New("cas retries exceeded")
+
+// IsCASRetriesExceeded asserts casRetriesExceededError. It is returned by
+// PutIf, Put, Delete and Apply when the configured retry budget is spent
+// without the compare-and-swap update landing.
+func IsCASRetriesExceeded(err error) bool {
+	return microerror.Cause(err) == casRetriesExceededError
+}
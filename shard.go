@@ -0,0 +1,275 @@
+package tprstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/giantswarm/microerror"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apismeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// shardCountAnnotation records a Storage's immutable shard count on the
+// bare TPO.Name object (its own object when ShardCount is 1, a dedicated
+// metadata object otherwise), so New can detect a caller opening the same
+// TPO with a mismatched TPOConfig.ShardCount regardless of which count is
+// larger.
+const shardCountAnnotation = "tprstorage.giantswarm.io/shard-count"
+
+// shardIndex hashes key to a shard in [0, shardCount).
+func shardIndex(key string, shardCount int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(shardCount))
+}
+
+// shardName returns the TPO/CR name shard i is stored under. Sharding is
+// opt-in: with a single shard the base TPO name is used unchanged so
+// existing unsharded data keeps working.
+func shardName(baseName string, shardCount, i int) string {
+	if shardCount <= 1 {
+		return baseName
+	}
+	return fmt.Sprintf("%s-shard-%d", baseName, i)
+}
+
+// shardName returns the name of the shard key hashes to.
+func (s *Storage) shardName(key string) string {
+	return shardName(s.tpoName, s.shardCount, shardIndex(key, s.shardCount))
+}
+
+func (s *Storage) namedEndpoint(name string) string {
+	return s.tpoListEndpoint + "/" + name
+}
+
+func (s *Storage) getNamedCustomObject(ctx context.Context, name string) (*customObject, error) {
+	res, err := s.k8sClient.Core().RESTClient().
+		Get().
+		Context(ctx).
+		AbsPath(s.namedEndpoint(name)).
+		DoRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var v customObject
+	err = json.Unmarshal(res, &v)
+	if err != nil {
+		return nil, microerror.Maskf(err, "unmarshal %s", name)
+	}
+
+	return &v, nil
+}
+
+// getOrCreateNamedCustomObject reads the TPO/CR called name, lazily
+// creating it (with an empty data map) if it does not exist yet.
+func (s *Storage) getOrCreateNamedCustomObject(ctx context.Context, name string, extraAnnotations map[string]string) (*customObject, error) {
+	obj, err := s.getNamedCustomObject(ctx, name)
+	if errors.IsNotFound(err) {
+		return s.createNamedCustomObject(ctx, name, extraAnnotations)
+	}
+	if err != nil {
+		return nil, microerror.Maskf(err, "get %s", name)
+	}
+
+	return obj, nil
+}
+
+func (s *Storage) createNamedCustomObject(ctx context.Context, name string, extraAnnotations map[string]string) (*customObject, error) {
+	annotations := map[string]string{
+		// Data must be not empty so patches do not fail.
+		"storageDoNotOmitempty": "non-empty",
+	}
+	for k, v := range extraAnnotations {
+		annotations[k] = v
+	}
+
+	tpo := customObject{
+		TypeMeta: apismeta.TypeMeta{
+			Kind:       s.kind,
+			APIVersion: s.apiVersion,
+		},
+		ObjectMeta: apismeta.ObjectMeta{
+			Name:        name,
+			Namespace:   s.tpoNamespace,
+			Annotations: annotations,
+		},
+		Data: map[string]string{},
+	}
+
+	body, err := json.Marshal(&tpo)
+	if err != nil {
+		return nil, microerror.Maskf(err, "marshaling %#v", tpo)
+	}
+
+	_, err = s.k8sClient.Core().RESTClient().
+		Post().
+		Context(ctx).
+		AbsPath(s.tpoListEndpoint).
+		Body(body).
+		DoRaw()
+	if errors.IsAlreadyExists(err) {
+		return s.getNamedCustomObject(ctx, name)
+	}
+	if err != nil {
+		return nil, microerror.Maskf(err, "creating %s", name)
+	}
+
+	return &tpo, nil
+}
+
+// readShardData returns the data stored in shard name, treating a shard
+// that has not been written to yet as empty rather than creating it.
+func (s *Storage) readShardData(ctx context.Context, name string) (map[string]string, error) {
+	obj, err := s.getNamedCustomObject(ctx, name)
+	if errors.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, microerror.Maskf(err, "get %s", name)
+	}
+
+	return obj.Data, nil
+}
+
+func (s *Storage) getShardData(ctx context.Context, key string) (map[string]string, error) {
+	return s.readShardData(ctx, s.shardName(key))
+}
+
+// List returns the keys stored under key, reading all shards in parallel
+// and merging the results. Every shard's full data map is fetched, so the
+// cost grows with the overall data size.
+func (s *Storage) List(ctx context.Context, key string) ([]string, error) {
+	lists := make([][]string, s.shardCount)
+
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < s.shardCount; i++ {
+		i := i
+		g.Go(func() error {
+			name := shardName(s.tpoName, s.shardCount, i)
+
+			data, err := s.readShardData(ctx, name)
+			if err != nil {
+				return microerror.Maskf(err, "listing %s", name)
+			}
+
+			lists[i] = matchPrefix(data, key)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, microerror.Maskf(err, "listing key=%s", key)
+	}
+
+	var list []string
+	for _, l := range lists {
+		list = append(list, l...)
+	}
+
+	return list, nil
+}
+
+func matchPrefix(data map[string]string, key string) []string {
+	var list []string
+
+	keyLen := len(key)
+	for k := range data {
+		if !strings.HasPrefix(k, key) {
+			continue
+		}
+
+		// k must be exact match or be separated with /.
+		// I.e. /foo is under /foo/bar but not under /foobar.
+		if len(k) != keyLen && k[keyLen] != '/' {
+			continue
+		}
+
+		list = append(list, k[keyLen+1:])
+	}
+
+	return list
+}
+
+// Rebalance reads every existing shard, redistributes their keys across
+// newShardCount shards, and writes each new shard back under CAS, so an
+// operator can grow (or shrink) the shard count without downtime. Callers
+// must reconstruct Storage with TPOConfig.ShardCount set to newShardCount
+// afterwards.
+func (s *Storage) Rebalance(ctx context.Context, newShardCount int) error {
+	if newShardCount <= 0 {
+		return microerror.Maskf(invalidConfigError, "newShardCount must be positive")
+	}
+
+	all := map[string]string{}
+	for i := 0; i < s.shardCount; i++ {
+		name := shardName(s.tpoName, s.shardCount, i)
+
+		data, err := s.readShardData(ctx, name)
+		if err != nil {
+			return microerror.Maskf(err, "reading %s", name)
+		}
+		for k, v := range data {
+			all[k] = v
+		}
+	}
+
+	redistributed := make([]map[string]string, newShardCount)
+	for i := range redistributed {
+		redistributed[i] = map[string]string{}
+	}
+	for k, v := range all {
+		i := shardIndex(k, newShardCount)
+		redistributed[i][k] = v
+	}
+
+	newNames := map[string]bool{}
+	for i, data := range redistributed {
+		name := shardName(s.tpoName, newShardCount, i)
+		newNames[name] = true
+
+		err := s.casUpdateNamed(ctx, name, func(current map[string]string) (map[string]string, error) {
+			return data, nil
+		}, nil)
+		if err != nil {
+			return microerror.Maskf(err, "writing %s", name)
+		}
+	}
+
+	// Old shard names that are not reused under the new topology (e.g.
+	// the bare tpoName when going from unsharded to newShardCount>1)
+	// would otherwise be left behind holding the full stale dataset, so
+	// clear them out.
+	for i := 0; i < s.shardCount; i++ {
+		name := shardName(s.tpoName, s.shardCount, i)
+		if newNames[name] {
+			continue
+		}
+
+		err := s.casUpdateNamed(ctx, name, func(current map[string]string) (map[string]string, error) {
+			return map[string]string{}, nil
+		}, nil)
+		if err != nil {
+			return microerror.Maskf(err, "clearing stale shard %s", name)
+		}
+	}
+
+	// Record the new shard count on the bare tpoName object, the same
+	// canonical location New checks, as part of a compare-and-swap PUT
+	// rather than a separate unguarded GET+PUT: this object may already
+	// have been written above with real shard 0 data (newShardCount<=1)
+	// by a concurrent writer, and an unprotected follow-up write here
+	// would silently clobber it.
+	err := s.casUpdateNamed(ctx, s.tpoName, func(current map[string]string) (map[string]string, error) {
+		return current, nil
+	}, map[string]string{shardCountAnnotation: strconv.Itoa(newShardCount)})
+	if err != nil {
+		return microerror.Maskf(err, "recording shard count on %s", s.tpoName)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package tprstorage
+
+import "testing"
+
+func TestShardName(t *testing.T) {
+	tests := []struct {
+		baseName   string
+		shardCount int
+		i          int
+		expected   string
+	}{
+		{"foo", 0, 0, "foo"},
+		{"foo", 1, 0, "foo"},
+		{"foo", 2, 0, "foo-shard-0"},
+		{"foo", 2, 1, "foo-shard-1"},
+		{"foo", 5, 3, "foo-shard-3"},
+	}
+
+	for _, tc := range tests {
+		actual := shardName(tc.baseName, tc.shardCount, tc.i)
+		if actual != tc.expected {
+			t.Errorf("shardName(%#q, %d, %d) == %#q, want %#q", tc.baseName, tc.shardCount, tc.i, actual, tc.expected)
+		}
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	const shardCount = 8
+
+	for _, key := range []string{"a", "foo/bar", "baz", ""} {
+		i := shardIndex(key, shardCount)
+		if i < 0 || i >= shardCount {
+			t.Errorf("shardIndex(%#q, %d) == %d, want value in [0, %d)", key, shardCount, i, shardCount)
+		}
+
+		// shardIndex must be deterministic: the same key always has to
+		// land on the same shard, or Put and Get would disagree on
+		// where a key lives.
+		again := shardIndex(key, shardCount)
+		if again != i {
+			t.Errorf("shardIndex(%#q, %d) == %d on first call but %d on second", key, shardCount, i, again)
+		}
+	}
+}
+
+func TestShardIndexDistributesKeys(t *testing.T) {
+	const shardCount = 4
+
+	seen := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		key := shardName("key", 1000, i)
+		seen[shardIndex(key, shardCount)] = true
+	}
+
+	if len(seen) != shardCount {
+		t.Errorf("shardIndex only used %d of %d shards across 1000 keys", len(seen), shardCount)
+	}
+}
+
+func TestMatchPrefix(t *testing.T) {
+	data := map[string]string{
+		"foo/bar":     "2",
+		"foo/baz":     "3",
+		"foobar":      "4",
+		"foo/bar/qux": "5",
+	}
+
+	actual := matchPrefix(data, "foo")
+	expected := map[string]bool{"bar": true, "baz": true, "bar/qux": true}
+
+	if len(actual) != len(expected) {
+		t.Fatalf("matchPrefix returned %v, want keys %v", actual, expected)
+	}
+	for _, k := range actual {
+		if !expected[k] {
+			t.Errorf("matchPrefix returned unexpected key %#q", k)
+		}
+	}
+}
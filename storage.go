@@ -2,15 +2,14 @@ package tprstorage
 
 import (
 	"context"
-	"encoding/json"
-	"strings"
+	"strconv"
 
 	"github.com/giantswarm/microerror"
 	"github.com/giantswarm/micrologger"
 	"github.com/giantswarm/operatorkit/tpr"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/apimachinery/pkg/api/errors"
 	apismeta "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	api "k8s.io/client-go/pkg/api/v1"
 )
@@ -21,23 +20,49 @@ type TPRConfig struct {
 
 type TPOConfig struct {
 	Name, Namespace string
+
+	// ShardCount is the number of TPOs/CRs the keyspace is sharded
+	// across. Keys are distributed with fnv64a(key) % ShardCount.
+	// Defaults to 1 (no sharding, fully backwards compatible with a
+	// single TPO named Name). Once a Storage has been created with a
+	// given ShardCount it is immutable; New returns invalidConfigError
+	// if a later caller passes a different value. Use Rebalance to
+	// change it.
+	ShardCount int
 }
 
 type Config struct {
 	// Dependencies.
 
 	K8sClient kubernetes.Interface
-	Logger    micrologger.Logger
+	// APIExtClient is required when Backend is BackendCRD or BackendAuto.
+	// It is used to create the CustomResourceDefinition data is stored
+	// in.
+	APIExtClient apiextensionsclientset.Interface
+	Logger       micrologger.Logger
 
 	// Settings.
 
+	// Backend selects which Kubernetes API is used to store data. Its
+	// zero value resolves to BackendAuto.
+	Backend Backend
+
 	// TPR is the third party resource where data objects are stored.
+	// Only used when Backend resolves to BackendTPR.
 	TPR TPRConfig
 
-	// TPOName is the third party object used to store data. This object
-	// will be created inside a third party resource specified by TPR. If
-	// the object already exists it will be reused. It is safe to run
-	// multiple Storage instances using the same TPO.
+	// CRD is the custom resource definition data objects are stored
+	// under. Only used when Backend resolves to BackendCRD.
+	CRD CRDConfig
+
+	// CAS configures the retry budget used by PutIf and the operations
+	// built on top of it (Put, Delete, Apply).
+	CAS CASConfig
+
+	// TPO is the third party object / custom resource used to store
+	// data. This object will be created inside the resource specified by
+	// TPR or CRD. If the object already exists it will be reused. It is
+	// safe to run multiple Storage instances using the same TPO.
 	TPO TPOConfig
 }
 
@@ -45,17 +70,30 @@ func DefaultConfig() Config {
 	return Config{
 		// Dependencies.
 
-		K8sClient: nil, // Required.
-		Logger:    nil, // Required.
+		K8sClient:    nil, // Required.
+		APIExtClient: nil, // Required for BackendCRD and BackendAuto.
+		Logger:       nil, // Required.
 
 		// Settings.
 
+		Backend: BackendAuto,
+
 		TPR: TPRConfig{
 			Name:        "tpr-storage.giantswarm.io",
 			Version:     "v1",
 			Description: "Storage data managed by github.com/giantswarm/tprstorage",
 		},
 
+		CRD: CRDConfig{
+			Group:       "giantswarm.io",
+			Version:     "v1",
+			Description: "Storage data managed by github.com/giantswarm/tprstorage",
+		},
+
+		CAS: CASConfig{
+			MaxRetries: 10,
+		},
+
 		TPO: TPOConfig{
 			Name:      "", // Required.
 			Namespace: "giantswarm",
@@ -70,8 +108,15 @@ type Storage struct {
 	k8sClient kubernetes.Interface
 	tpr       *tpr.TPR
 
-	tpoEndpoint     string
+	backend         Backend
+	tpoName         string
+	tpoNamespace    string
 	tpoListEndpoint string
+	kind            string
+	apiVersion      string
+	shardCount      int
+
+	casMaxRetries int
 }
 
 func New(ctx context.Context, config Config) (*Storage, error) {
@@ -81,13 +126,6 @@ func New(ctx context.Context, config Config) (*Storage, error) {
 	if config.Logger == nil {
 		return nil, microerror.Maskf(invalidConfigError, "config.Logger is nil")
 	}
-	if config.TPR.Name == "" {
-		return nil, microerror.Maskf(invalidConfigError, "config.TPR.Name is empty")
-	}
-	if config.TPR.Version == "" {
-		return nil, microerror.Maskf(invalidConfigError, "config.TPR.Version is empty")
-	}
-	// config.TPR.Description is OK to be empty.
 	if config.TPO.Name == "" {
 		return nil, microerror.Maskf(invalidConfigError, "config.TPO.Name is empty")
 	}
@@ -95,46 +133,81 @@ func New(ctx context.Context, config Config) (*Storage, error) {
 		config.TPO.Namespace = "default"
 	}
 
-	var newTPR *tpr.TPR
-	{
-		c := tpr.DefaultConfig()
-
-		c.Logger = config.Logger
-
-		c.K8sClient = config.K8sClient
-
-		c.Name = config.TPR.Name
-		c.Version = config.TPR.Version
-		c.Description = config.TPR.Description
-
+	backend := config.Backend
+	if backend == "" {
+		backend = BackendAuto
+	}
+	if backend == BackendAuto {
 		var err error
 
-		newTPR, err = tpr.New(c)
+		backend, err = detectBackend(config.K8sClient)
 		if err != nil {
 			return nil, microerror.Mask(err)
 		}
 	}
 
+	casMaxRetries := config.CAS.MaxRetries
+	if casMaxRetries <= 0 {
+		casMaxRetries = DefaultConfig().CAS.MaxRetries
+	}
+
+	shardCount := config.TPO.ShardCount
+	if shardCount <= 0 {
+		shardCount = 1
+	}
+
 	s := &Storage{
 		k8sClient: config.K8sClient,
-		tpr:       newTPR,
+		backend:   backend,
+
+		tpoName:      config.TPO.Name,
+		tpoNamespace: config.TPO.Namespace,
+		shardCount:   shardCount,
 
-		tpoEndpoint:     newTPR.Endpoint(config.TPO.Namespace) + "/" + config.TPO.Name,
-		tpoListEndpoint: newTPR.Endpoint(config.TPO.Namespace),
+		casMaxRetries: casMaxRetries,
 
 		logger: config.Logger.With(
-			"tprName", config.TPR.Name,
-			"tprVersion", config.TPR.Version,
+			"backend", backend,
 			"tpoName", config.TPO.Name,
 			"tpoNamespace", config.TPO.Namespace,
+			"shardCount", shardCount,
 		),
 	}
 
-	// TODO extract init func
+	var kind, apiVersion string
 
-	// Create TPR resource.
-	{
-		err := s.tpr.CreateAndWait()
+	switch backend {
+	case BackendTPR:
+		if config.TPR.Name == "" {
+			return nil, microerror.Maskf(invalidConfigError, "config.TPR.Name is empty")
+		}
+		if config.TPR.Version == "" {
+			return nil, microerror.Maskf(invalidConfigError, "config.TPR.Version is empty")
+		}
+		// config.TPR.Description is OK to be empty.
+
+		c := tpr.DefaultConfig()
+
+		c.Logger = config.Logger
+
+		c.K8sClient = config.K8sClient
+
+		c.Name = config.TPR.Name
+		c.Version = config.TPR.Version
+		c.Description = config.TPR.Description
+
+		newTPR, err := tpr.New(c)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		s.tpr = newTPR
+		s.tpoListEndpoint = newTPR.Endpoint(config.TPO.Namespace)
+		kind = newTPR.Kind()
+		apiVersion = newTPR.APIVersion()
+
+		// Create TPR resource.
+		err = s.tpr.CreateAndWait()
 		if tpr.IsAlreadyExists(err) {
 			s.logger.Log("debug", "TPR already exists")
 		} else if err != nil {
@@ -142,8 +215,37 @@ func New(ctx context.Context, config Config) (*Storage, error) {
 		} else {
 			s.logger.Log("debug", "TPR created")
 		}
+	case BackendCRD:
+		if config.APIExtClient == nil {
+			return nil, microerror.Maskf(invalidConfigError, "config.APIExtClient is nil")
+		}
+		if config.CRD.Group == "" {
+			return nil, microerror.Maskf(invalidConfigError, "config.CRD.Group is empty")
+		}
+		if config.CRD.Version == "" {
+			return nil, microerror.Maskf(invalidConfigError, "config.CRD.Version is empty")
+		}
+		// config.CRD.Description is OK to be empty.
+
+		s.tpoListEndpoint = crdEndpoint(config.TPO.Namespace, config.CRD)
+		kind = crdKind
+		apiVersion = config.CRD.Group + "/" + config.CRD.Version
+
+		// Create CRD resource.
+		err := ensureCRD(ctx, config.APIExtClient, config.CRD)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		s.logger.Log("debug", "CRD ensured")
+	default:
+		return nil, microerror.Maskf(invalidConfigError, "config.Backend %#q is invalid", backend)
 	}
 
+	s.kind = kind
+	s.apiVersion = apiVersion
+
+	// TODO extract init func
+
 	// Create namespace.
 	{
 		ns := api.Namespace{
@@ -163,44 +265,43 @@ func New(ctx context.Context, config Config) (*Storage, error) {
 		}
 	}
 
-	// Create TPO.
+	// Record (and check) the shard count this Storage was actually
+	// created with on the bare TPO.Name object, regardless of the
+	// current call's ShardCount. This check cannot live on the name
+	// ShardCount resolves shard 0 to, like the rest of this block does:
+	// shardName(tpoName, 1, 0) and shardName(tpoName, N>1, 0) are
+	// different object names, so a caller reopening a ShardCount-4
+	// Storage with the default ShardCount 0/1 would skip a check scoped
+	// to shardCount>1 entirely and silently operate on a disjoint,
+	// near-empty object instead of getting invalidConfigError.
 	{
-		tpo := customObject{
-			TypeMeta: apismeta.TypeMeta{
-				Kind:       s.tpr.Kind(),
-				APIVersion: s.tpr.APIVersion(),
-			},
-			ObjectMeta: apismeta.ObjectMeta{
-				Name:      config.TPO.Name,
-				Namespace: config.TPO.Namespace,
-				Annotations: map[string]string{
-					"storageDoNotOmitempty": "non-empty",
-				},
-				// TODO think about labels
-			},
-
-			// Data must be not empty so patches do not fail.
-			Data: map[string]string{},
-		}
-		body, err := json.Marshal(&tpo)
+		meta, err := s.getOrCreateNamedCustomObject(ctx, s.tpoName, map[string]string{shardCountAnnotation: strconv.Itoa(shardCount)})
 		if err != nil {
-			return nil, microerror.Maskf(err, "marshaling %#v", tpo)
+			return nil, microerror.Mask(err)
 		}
-		_, err = s.k8sClient.Core().RESTClient().
-			Post().
-			Context(ctx).
-			AbsPath(s.tpoListEndpoint).
-			Body(body).
-			DoRaw()
-		if errors.IsAlreadyExists(err) {
-			s.logger.Log("debug", "TPO "+tpo.Name+" already exists")
-		} else if err != nil {
-			return nil, microerror.Maskf(err, "creating TPO %#v", tpo)
-		} else {
-			s.logger.Log("debug", "TPO "+tpo.Name+" created")
+
+		existing := meta.Annotations[shardCountAnnotation]
+		if existing != "" && existing != strconv.Itoa(shardCount) {
+			return nil, microerror.Maskf(invalidConfigError, "TPO %s was created with shard count %s, got %d", s.tpoName, existing, shardCount)
 		}
 	}
 
+	// Create shard 0. With ShardCount 1 this is the same bare TPO.Name
+	// object checked above; with a higher ShardCount it's a separate
+	// object holding the actual data.
+	{
+		name := shardName(s.tpoName, shardCount, 0)
+
+		if name != s.tpoName {
+			_, err := s.getOrCreateNamedCustomObject(ctx, name, nil)
+			if err != nil {
+				return nil, microerror.Mask(err)
+			}
+		}
+
+		s.logger.Log("debug", "shard 0 ready")
+	}
+
 	return s, nil
 }
 
@@ -213,38 +314,54 @@ func (s *Storage) Create(ctx context.Context, key, value string) error {
 }
 
 func (s *Storage) Put(ctx context.Context, key, value string) error {
-	var body []byte
-	{
-		v := struct {
-			Data map[string]string `json:"data"`
-		}{
-			Data: map[string]string{
-				key: value,
-			},
-		}
+	err := s.PutIf(ctx, key, func(data map[string]string) (map[string]string, error) {
+		data[key] = value
+		return data, nil
+	})
+	if err != nil {
+		return microerror.Maskf(err, "putting key=%s", key)
+	}
 
-		var err error
-		body, err = json.Marshal(&v)
-		if err != nil {
-			return microerror.Maskf(err, "marshaling %#v", v)
+	return nil
+}
+
+// Apply atomically applies a set of mutations. A nil value deletes the
+// key, any other value sets it. Mutations are grouped by the shard their
+// key hashes to and each group is applied under its own compare-and-swap;
+// all mutations targeting the same shard land atomically together, but
+// unlike a single-shard Storage the call as a whole is not atomic across
+// shards.
+func (s *Storage) Apply(ctx context.Context, mutations map[string]*string) error {
+	byShard := map[string]map[string]*string{}
+	for k, v := range mutations {
+		name := s.shardName(k)
+		if byShard[name] == nil {
+			byShard[name] = map[string]*string{}
 		}
+		byShard[name][k] = v
 	}
 
-	_, err := s.k8sClient.Core().RESTClient().
-		Patch(types.MergePatchType).
-		Context(ctx).
-		AbsPath(s.tpoEndpoint).
-		Body(body).
-		DoRaw()
-	if err != nil {
-		return microerror.Maskf(err, "putting key=%s, patch=%s", key, body)
+	for name, shardMutations := range byShard {
+		err := s.casUpdateNamed(ctx, name, func(data map[string]string) (map[string]string, error) {
+			for k, v := range shardMutations {
+				if v == nil {
+					delete(data, k)
+				} else {
+					data[k] = *v
+				}
+			}
+			return data, nil
+		}, nil)
+		if err != nil {
+			return microerror.Maskf(err, "applying %d mutations to %s", len(shardMutations), name)
+		}
 	}
 
 	return nil
 }
 
 func (s *Storage) Exists(ctx context.Context, key string) (bool, error) {
-	data, err := s.getData(ctx)
+	data, err := s.getShardData(ctx, key)
 	if err != nil {
 		return false, microerror.Maskf(err, "checking existence key=%s", key)
 	}
@@ -254,7 +371,7 @@ func (s *Storage) Exists(ctx context.Context, key string) (bool, error) {
 }
 
 func (s *Storage) Search(ctx context.Context, key string) (string, error) {
-	data, err := s.getData(ctx)
+	data, err := s.getShardData(ctx, key)
 	if err != nil {
 		return "", microerror.Maskf(err, "searching for key=%s", key)
 	}
@@ -267,78 +384,14 @@ func (s *Storage) Search(ctx context.Context, key string) (string, error) {
 	return v, nil
 }
 
-func (s *Storage) List(ctx context.Context, key string) ([]string, error) {
-	data, err := s.getData(ctx)
-	if err != nil {
-		return nil, microerror.Maskf(err, "listing key=%s", key)
-	}
-
-	var list []string
-
-	keyLen := len(key)
-	for k, _ := range data {
-		if !strings.HasPrefix(k, key) {
-			continue
-		}
-
-		// k must be exact match or be separated with /.
-		// I.e. /foo is under /foo/bar but not under /foobar.
-		if len(k) != keyLen && k[keyLen] != '/' {
-			continue
-		}
-
-		list = append(list, k[keyLen+1:])
-	}
-
-	return list, nil
-}
-
 func (s *Storage) Delete(ctx context.Context, key string) error {
-	var body []byte
-	{
-		v := struct {
-			Data map[string]*string `json:"data"`
-		}{
-			Data: map[string]*string{
-				key: nil,
-			},
-		}
-
-		var err error
-		body, err = json.Marshal(&v)
-		if err != nil {
-			return microerror.Maskf(err, "marshaling %#v", v)
-		}
-	}
-
-	_, err := s.k8sClient.Core().RESTClient().
-		Patch(types.MergePatchType).
-		Context(ctx).
-		AbsPath(s.tpoEndpoint).
-		Body(body).
-		DoRaw()
+	err := s.PutIf(ctx, key, func(data map[string]string) (map[string]string, error) {
+		delete(data, key)
+		return data, nil
+	})
 	if err != nil {
-		return microerror.Maskf(err, "deleting value for key=%s, patch=%s", key, body)
+		return microerror.Maskf(err, "deleting key=%s", key)
 	}
 
 	return nil
 }
-
-func (s *Storage) getData(ctx context.Context) (map[string]string, error) {
-	res, err := s.k8sClient.Core().RESTClient().
-		Get().
-		Context(ctx).
-		AbsPath(s.tpoEndpoint).
-		DoRaw()
-	if err != nil {
-		return nil, microerror.Maskf(err, "get TPO")
-	}
-
-	var v customObject
-	err = json.Unmarshal(res, &v)
-	if err != nil {
-		return nil, microerror.Maskf(err, "unmarshal TPO")
-	}
-
-	return v.Data, nil
-}
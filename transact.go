@@ -0,0 +1,122 @@
+package tprstorage
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/giantswarm/microerror"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// OpKind is the kind of a single Transact operation.
+type OpKind string
+
+const (
+	// OpPut sets Key to Value.
+	OpPut OpKind = "put"
+	// OpDelete removes Key. It fails the whole transaction if Key does
+	// not exist.
+	OpDelete OpKind = "delete"
+	// OpAssert is a precondition: it fails the whole transaction unless
+	// Key currently equals Value.
+	OpAssert OpKind = "assert"
+)
+
+// Op is a single operation submitted to Transact.
+type Op struct {
+	Kind  OpKind
+	Key   string
+	Value string
+}
+
+// jsonPatchOp is one operation of an RFC 6902 JSON Patch document.
+type jsonPatchOp struct {
+	Op    string  `json:"op"`
+	Path  string  `json:"path"`
+	Value *string `json:"value,omitempty"`
+}
+
+// Transact applies ops as a single RFC 6902 JSON Patch against each shard
+// they touch, so every operation against that shard lands or none do.
+// OpAssert entries become "test" operations, giving callers a
+// precondition (e.g. "only delete A if it still equals X"). Ops whose
+// keys hash to different shards are NOT atomic with each other, only
+// within their own shard.
+func (s *Storage) Transact(ctx context.Context, ops []Op) error {
+	byShard := map[string][]Op{}
+	for _, op := range ops {
+		name := s.shardName(op.Key)
+		byShard[name] = append(byShard[name], op)
+	}
+
+	for name, shardOps := range byShard {
+		err := s.transactShard(ctx, name, shardOps)
+		if err != nil {
+			return microerror.Maskf(err, "transacting on %s", name)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) transactShard(ctx context.Context, name string, ops []Op) error {
+	// The shard must exist before we can JSON Patch its /data path.
+	_, err := s.getOrCreateNamedCustomObject(ctx, name, nil)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	patch := make([]jsonPatchOp, 0, len(ops))
+	for _, op := range ops {
+		path := "/data/" + jsonPointerEscape(op.Key)
+
+		switch op.Kind {
+		case OpPut:
+			// "add" to an existing object member replaces its value
+			// (RFC 6902 section 4.1), so it covers both insert and
+			// overwrite without needing to know beforehand whether Key
+			// already exists.
+			v := op.Value
+			patch = append(patch, jsonPatchOp{Op: "add", Path: path, Value: &v})
+		case OpDelete:
+			patch = append(patch, jsonPatchOp{Op: "remove", Path: path})
+		case OpAssert:
+			v := op.Value
+			patch = append(patch, jsonPatchOp{Op: "test", Path: path, Value: &v})
+		default:
+			return microerror.Maskf(invalidConfigError, "op.Kind %#q is invalid", op.Kind)
+		}
+	}
+
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return microerror.Maskf(err, "marshaling %#v", patch)
+	}
+
+	if _, err := jsonpatch.DecodePatch(body); err != nil {
+		return microerror.Maskf(err, "validating JSON patch %s", body)
+	}
+
+	_, err = s.k8sClient.Core().RESTClient().
+		Patch(types.JSONPatchType).
+		Context(ctx).
+		AbsPath(s.namedEndpoint(name)).
+		Body(body).
+		DoRaw()
+	if err != nil {
+		return microerror.Maskf(err, "applying JSON patch %s", body)
+	}
+
+	return nil
+}
+
+// jsonPointerEscape escapes key for use inside a JSON Pointer segment, per
+// RFC 6901: ~ becomes ~0 and / becomes ~1. Order matters: ~ must be
+// escaped first so it does not double-escape the ~ introduced for /.
+func jsonPointerEscape(key string) string {
+	key = strings.Replace(key, "~", "~0", -1)
+	key = strings.Replace(key, "/", "~1", -1)
+	return key
+}
@@ -0,0 +1,25 @@
+package tprstorage
+
+import "testing"
+
+func TestJSONPointerEscape(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"foo", "foo"},
+		{"foo/bar", "foo~1bar"},
+		{"foo~bar", "foo~0bar"},
+		// ~ must be escaped before /, or the ~1 introduced for / would
+		// itself be escaped into ~01.
+		{"foo~/bar", "foo~0~1bar"},
+		{"a/b~c", "a~1b~0c"},
+	}
+
+	for _, tc := range tests {
+		actual := jsonPointerEscape(tc.key)
+		if actual != tc.expected {
+			t.Errorf("jsonPointerEscape(%#q) == %#q, want %#q", tc.key, actual, tc.expected)
+		}
+	}
+}
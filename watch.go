@@ -0,0 +1,265 @@
+package tprstorage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// EventType describes what happened to a key.
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event is emitted on the channel returned by Watch whenever a key under
+// the watched prefix changes.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value string
+	// RevisionVersion is the resourceVersion of the shard the change was
+	// observed on.
+	RevisionVersion string
+}
+
+// watchRetryBackoff is how long a shard watcher waits before re-opening a
+// watch after the API server closed it or returned an error.
+const watchRetryBackoff = time.Second
+
+// Watch streams Put/Delete events for every key under keyPrefix, using
+// the same /-boundary rule as List. It opens one watch per shard and
+// diffs successive data map snapshots to synthesize per-key events.
+func (s *Storage) Watch(ctx context.Context, keyPrefix string) (<-chan Event, error) {
+	watchers := make([]*shardWatcher, s.shardCount)
+	for i := 0; i < s.shardCount; i++ {
+		name := shardName(s.tpoName, s.shardCount, i)
+
+		w, err := s.newShardWatcher(ctx, name)
+		if err != nil {
+			return nil, microerror.Maskf(err, "starting watch on %s", name)
+		}
+		watchers[i] = w
+	}
+
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+
+		var wg sync.WaitGroup
+		for _, w := range watchers {
+			wg.Add(1)
+			go func(w *shardWatcher) {
+				defer wg.Done()
+				w.run(ctx, keyPrefix, events)
+			}(w)
+		}
+		wg.Wait()
+	}()
+
+	return events, nil
+}
+
+// shardWatcher tracks one shard's last known data map so it can diff
+// incoming watch events into per-key Events.
+type shardWatcher struct {
+	storage *Storage
+	name    string
+
+	data            map[string]string
+	resourceVersion string
+}
+
+func (s *Storage) newShardWatcher(ctx context.Context, name string) (*shardWatcher, error) {
+	obj, err := s.getNamedCustomObject(ctx, name)
+	if errors.IsNotFound(err) {
+		obj = &customObject{Data: map[string]string{}}
+	} else if err != nil {
+		return nil, microerror.Maskf(err, "get %s", name)
+	}
+
+	w := &shardWatcher{
+		storage:         s,
+		name:            name,
+		resourceVersion: obj.ResourceVersion,
+	}
+	w.data = copyData(obj.Data)
+
+	return w, nil
+}
+
+// run keeps re-opening the watch until ctx is cancelled, relisting
+// whenever the API server closes the stream (e.g. the watched
+// resourceVersion expired with a 410 Gone).
+func (w *shardWatcher) run(ctx context.Context, keyPrefix string, events chan<- Event) {
+	for ctx.Err() == nil {
+		stream, err := w.openWatch(ctx)
+		if err != nil {
+			w.relist(ctx, keyPrefix, events)
+			time.Sleep(watchRetryBackoff)
+			continue
+		}
+
+		w.consume(ctx, stream, keyPrefix, events)
+	}
+}
+
+func (w *shardWatcher) openWatch(ctx context.Context) (io.ReadCloser, error) {
+	return w.storage.k8sClient.Core().RESTClient().
+		Get().
+		Context(ctx).
+		AbsPath(w.storage.namedEndpoint(w.name)).
+		Param("watch", "true").
+		Param("resourceVersion", w.resourceVersion).
+		Stream()
+}
+
+// rawWatchEvent is the shape the API server frames each event of a watch
+// stream in. Its "object" is decoded straight into a customObject below
+// rather than going through ev.Object from a typed watch.Interface: this
+// package never registers customObject with a runtime.Scheme, so the
+// client's negotiated serializer has no way to produce one, the same
+// reason every other call in this package uses DoRaw()+json.Unmarshal
+// instead of the typed clientset.
+type rawWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (w *shardWatcher) consume(ctx context.Context, stream io.ReadCloser, keyPrefix string, events chan<- Event) {
+	defer stream.Close()
+
+	dec := json.NewDecoder(stream)
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		var ev rawWatchEvent
+		err := dec.Decode(&ev)
+		if err != nil {
+			// The stream closed, most commonly because the watched
+			// resourceVersion expired with a 410 Gone; relist in case
+			// we missed anything and let run re-open a fresh watch.
+			w.relist(ctx, keyPrefix, events)
+			return
+		}
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			var obj customObject
+			err := json.Unmarshal(ev.Object, &obj)
+			if err != nil {
+				continue
+			}
+			w.resourceVersion = obj.ResourceVersion
+			if !w.diff(ctx, obj.Data, obj.ResourceVersion, keyPrefix, events) {
+				return
+			}
+		case "DELETED":
+			if !w.diff(ctx, map[string]string{}, w.resourceVersion, keyPrefix, events) {
+				return
+			}
+		case "ERROR":
+			// Relist and emit synthetic Put events so subscribers can
+			// rebuild their caches, the same way client-go informers
+			// recover from Gone.
+			w.relist(ctx, keyPrefix, events)
+			return
+		}
+	}
+}
+
+// relist re-reads the shard from scratch and emits a synthetic Put for
+// every key under keyPrefix, regardless of whether it changed, so a
+// subscriber that may have missed events can rebuild its cache.
+func (w *shardWatcher) relist(ctx context.Context, keyPrefix string, events chan<- Event) {
+	obj, err := w.storage.getNamedCustomObject(ctx, w.name)
+	if errors.IsNotFound(err) {
+		obj = &customObject{Data: map[string]string{}}
+	} else if err != nil {
+		return
+	}
+
+	for k, v := range obj.Data {
+		if !matchesPrefix(k, keyPrefix) {
+			continue
+		}
+		if !sendEvent(ctx, events, Event{Type: EventPut, Key: k, Value: v, RevisionVersion: obj.ResourceVersion}) {
+			return
+		}
+	}
+
+	w.data = copyData(obj.Data)
+	w.resourceVersion = obj.ResourceVersion
+}
+
+// diff emits a Put/Delete Event for every key that changed between w.data
+// and newData, then adopts newData as the new baseline. It returns false
+// if ctx was cancelled mid-send, so callers can stop without leaking the
+// goroutine blocked on a subscriber that has stopped draining events.
+func (w *shardWatcher) diff(ctx context.Context, newData map[string]string, rv, keyPrefix string, events chan<- Event) bool {
+	for k, v := range newData {
+		if !matchesPrefix(k, keyPrefix) {
+			continue
+		}
+		if old, existed := w.data[k]; !existed || old != v {
+			if !sendEvent(ctx, events, Event{Type: EventPut, Key: k, Value: v, RevisionVersion: rv}) {
+				return false
+			}
+		}
+	}
+
+	for k := range w.data {
+		if !matchesPrefix(k, keyPrefix) {
+			continue
+		}
+		if _, ok := newData[k]; !ok {
+			if !sendEvent(ctx, events, Event{Type: EventDelete, Key: k, RevisionVersion: rv}) {
+				return false
+			}
+		}
+	}
+
+	w.data = copyData(newData)
+	return true
+}
+
+// sendEvent delivers ev on events, but bails out instead of blocking
+// forever if ctx is cancelled while no one is draining events (the
+// normal shutdown pattern: a Watch caller cancels ctx and stops reading).
+func sendEvent(ctx context.Context, events chan<- Event, ev Event) bool {
+	select {
+	case events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func copyData(data map[string]string) map[string]string {
+	out := make(map[string]string, len(data))
+	for k, v := range data {
+		out[k] = v
+	}
+	return out
+}
+
+// matchesPrefix applies the same /-boundary rule List uses: key must
+// either equal prefix or be separated from it by a /.
+func matchesPrefix(key, prefix string) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	return len(key) == len(prefix) || key[len(prefix)] == '/'
+}
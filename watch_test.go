@@ -0,0 +1,57 @@
+package tprstorage
+
+import "testing"
+
+func TestMatchesPrefix(t *testing.T) {
+	tests := []struct {
+		key      string
+		prefix   string
+		expected bool
+	}{
+		{"foo", "foo", true},
+		{"foo/bar", "foo", true},
+		{"foo/bar/baz", "foo", true},
+		{"foobar", "foo", false},
+		{"bar", "foo", false},
+		{"fo", "foo", false},
+	}
+
+	for _, tc := range tests {
+		actual := matchesPrefix(tc.key, tc.prefix)
+		if actual != tc.expected {
+			t.Errorf("matchesPrefix(%#q, %#q) == %t, want %t", tc.key, tc.prefix, actual, tc.expected)
+		}
+	}
+}
+
+func TestCopyData(t *testing.T) {
+	orig := map[string]string{"a": "1", "b": "2"}
+
+	cp := copyData(orig)
+	if len(cp) != len(orig) {
+		t.Fatalf("copyData returned %v, want same contents as %v", cp, orig)
+	}
+	for k, v := range orig {
+		if cp[k] != v {
+			t.Errorf("copyData()[%#q] == %#q, want %#q", k, cp[k], v)
+		}
+	}
+
+	// Mutating the copy must not affect the original, or casUpdateNamed's
+	// before-snapshot would still alias the map tryUpdate mutates.
+	cp["a"] = "changed"
+	if orig["a"] != "1" {
+		t.Errorf("mutating copyData's result changed the original map: %v", orig)
+	}
+}
+
+func TestCasJitteredBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		for i := 0; i < 100; i++ {
+			d := casJitteredBackoff(attempt)
+			if d < 0 || d > casBackoffMax {
+				t.Fatalf("casJitteredBackoff(%d) == %s, want value in [0, %s]", attempt, d, casBackoffMax)
+			}
+		}
+	}
+}